@@ -0,0 +1,269 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const fxRateIndex = "fxrate~base~quote"
+const fxTradeIndex = "fxtrade~txid"
+const adminRoleIndex = "role~admin~mspid"
+
+const rateMicrosScale = 1_000_000
+
+// FXRate is the latest known exchange rate from base to quote, expressed as
+// rateMicros = (quote per base) * 1_000_000 so it can be stored as an integer.
+type FXRate struct {
+	Base       string
+	Quote      string
+	RateMicros int64
+	ExpiresAt  int64
+	UpdatedAt  int64
+}
+
+// FXTrade is an audit record of a single CrossCurrencyTransaction, persisted
+// under its txid so GetAccountHistory-style consumers can render the
+// conversion leg alongside the balance changes it produced.
+type FXTrade struct {
+	TxID         string
+	FromAccount  string
+	ToAccount    string
+	FromCurrency string
+	ToCurrency   string
+	AmountFrom   int
+	AmountTo     int
+	RateMicros   int64
+	Timestamp    int64
+}
+
+// isAdmin returns true when the calling identity's MSP has been granted the
+// admin role via AddAdmin.
+func (t *AccountStorage) isAdmin(ctx contractapi.TransactionContextInterface) (bool, error) {
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return false, fmt.Errorf("failed to get caller mspid: %v", err)
+	}
+
+	adminKey, err := ctx.GetStub().CreateCompositeKey(adminRoleIndex, []string{mspID})
+	if err != nil {
+		return false, err
+	}
+
+	adminBytes, err := ctx.GetStub().GetState(adminKey)
+	if err != nil {
+		return false, err
+	}
+
+	return adminBytes != nil, nil
+}
+
+// requireAdmin returns an error unless the calling identity's MSP holds the admin role.
+func (t *AccountStorage) requireAdmin(ctx contractapi.TransactionContextInterface) error {
+	admin, err := t.isAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return fmt.Errorf("caller is not an admin")
+	}
+	return nil
+}
+
+// AddAdmin grants the admin role to mspID, which allows it to call
+// SetFXRate. The very first admin may bootstrap the role registry; every
+// subsequent grant must itself come from an existing admin.
+func (t *AccountStorage) AddAdmin(ctx contractapi.TransactionContextInterface, mspID string) error {
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(adminRoleIndex, []string{})
+	if err != nil {
+		return err
+	}
+	anyAdmins := iterator.HasNext()
+	iterator.Close()
+
+	if anyAdmins {
+		if err := t.requireAdmin(ctx); err != nil {
+			return err
+		}
+	}
+
+	adminKey, err := ctx.GetStub().CreateCompositeKey(adminRoleIndex, []string{mspID})
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(adminKey, []byte{0x00})
+}
+
+// SetFXRate records the current exchange rate from base to quote. Only
+// callers whose MSP holds the admin role may set rates.
+func (t *AccountStorage) SetFXRate(ctx contractapi.TransactionContextInterface, base, quote string, rateMicros int64, expiresAt int64) error {
+	if err := t.requireAdmin(ctx); err != nil {
+		return err
+	}
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+
+	rate := &FXRate{
+		Base:       base,
+		Quote:      quote,
+		RateMicros: rateMicros,
+		ExpiresAt:  expiresAt,
+		UpdatedAt:  txTimestamp.Seconds,
+	}
+
+	rateBytes, err := json.Marshal(rate)
+	if err != nil {
+		return err
+	}
+
+	rateKey, err := ctx.GetStub().CreateCompositeKey(fxRateIndex, []string{base, quote})
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(rateKey, rateBytes)
+}
+
+// GetFXRate returns the most recently set exchange rate from base to quote.
+func (t *AccountStorage) GetFXRate(ctx contractapi.TransactionContextInterface, base, quote string) (*FXRate, error) {
+	rateKey, err := ctx.GetStub().CreateCompositeKey(fxRateIndex, []string{base, quote})
+	if err != nil {
+		return nil, err
+	}
+
+	rateBytes, err := ctx.GetStub().GetState(rateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get fx rate %s/%s: %v", base, quote, err)
+	}
+	if rateBytes == nil {
+		return nil, fmt.Errorf("no fx rate for %s/%s", base, quote)
+	}
+
+	var rate FXRate
+	if err := json.Unmarshal(rateBytes, &rate); err != nil {
+		return nil, err
+	}
+
+	return &rate, nil
+}
+
+// ReadFXTrade retrieves the audit record of a past CrossCurrencyTransaction by
+// txid. Callers that want the conversion leg joined into an account's full
+// history instead should use GetAccountHistory, whose results carry it in
+// the FXTrade field.
+func (t *AccountStorage) ReadFXTrade(ctx contractapi.TransactionContextInterface, txID string) (*FXTrade, error) {
+	trade, err := t.lookupFXTrade(ctx, txID)
+	if err != nil {
+		return nil, err
+	}
+	if trade == nil {
+		return nil, fmt.Errorf("no fx trade for tx %s", txID)
+	}
+
+	return trade, nil
+}
+
+// crossCurrencyPayload is the deterministic byte encoding of a
+// CrossCurrencyTransaction request that fromAcc's participant must sign.
+func crossCurrencyPayload(fromAcc, toAcc string, amountFrom int, minAmountTo int, maxRateAgeSec, nonce int64) []byte {
+	return []byte(fmt.Sprintf("%s%s%d%d%d%d", fromAcc, toAcc, amountFrom, minAmountTo, maxRateAgeSec, nonce))
+}
+
+// CrossCurrencyTransaction converts amountFrom units of fromAcc's currency
+// into toAcc's currency using the latest SetFXRate quote, debiting fromAcc
+// and crediting toAcc. It aborts if the resulting amount is below
+// minAmountTo (slippage protection) or if the rate is older than
+// maxRateAgeSec relative to the current transaction timestamp. sigHex must be
+// a signature by the participant who owns fromAcc over crossCurrencyPayload,
+// and nonce must not have been used before by that participant.
+func (t *AccountStorage) CrossCurrencyTransaction(ctx contractapi.TransactionContextInterface, fromAcc, toAcc string, amountFrom int, minAmountTo int, maxRateAgeSec int64, nonce int64, sigHex string) error {
+	if err := t.requireAuthorizedCaller(ctx, fromAcc, nonce, crossCurrencyPayload(fromAcc, toAcc, amountFrom, minAmountTo, maxRateAgeSec, nonce), sigHex); err != nil {
+		return err
+	}
+
+	sender, err := t.ReadAccount(ctx, fromAcc)
+	if err != nil {
+		return err
+	}
+
+	recipient, err := t.ReadAccount(ctx, toAcc)
+	if err != nil {
+		return err
+	}
+
+	rate, err := t.GetFXRate(ctx, sender.Currency, recipient.Currency)
+	if err != nil {
+		return err
+	}
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+	now := txTimestamp.Seconds
+
+	if rate.ExpiresAt != 0 && rate.ExpiresAt <= now {
+		return fmt.Errorf("fx rate %s/%s has expired", sender.Currency, recipient.Currency)
+	}
+	if now-rate.UpdatedAt > maxRateAgeSec {
+		return fmt.Errorf("fx rate %s/%s is stale: %d seconds old, max %d", sender.Currency, recipient.Currency, now-rate.UpdatedAt, maxRateAgeSec)
+	}
+
+	amountTo := int(int64(amountFrom) * rate.RateMicros / rateMicrosScale)
+	if amountTo < minAmountTo {
+		return fmt.Errorf("slippage exceeded: would receive %d, wanted at least %d", amountTo, minAmountTo)
+	}
+
+	if sender.Balance < amountFrom {
+		return fmt.Errorf("insufficient balance: have %d, need %d", sender.Balance, amountFrom)
+	}
+
+	sender.Balance -= amountFrom
+	recipient.Balance += amountTo
+
+	senderBytes, err := json.Marshal(sender)
+	if err != nil {
+		return err
+	}
+	recipientBytes, err := json.Marshal(recipient)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.GetStub().PutState(fromAcc, senderBytes); err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutState(toAcc, recipientBytes); err != nil {
+		return err
+	}
+
+	txID := ctx.GetStub().GetTxID()
+	trade := &FXTrade{
+		TxID:         txID,
+		FromAccount:  fromAcc,
+		ToAccount:    toAcc,
+		FromCurrency: sender.Currency,
+		ToCurrency:   recipient.Currency,
+		AmountFrom:   amountFrom,
+		AmountTo:     amountTo,
+		RateMicros:   rate.RateMicros,
+		Timestamp:    now,
+	}
+
+	tradeBytes, err := json.Marshal(trade)
+	if err != nil {
+		return err
+	}
+
+	tradeKey, err := ctx.GetStub().CreateCompositeKey(fxTradeIndex, []string{txID})
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(tradeKey, tradeBytes)
+}
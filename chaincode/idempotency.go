@@ -0,0 +1,451 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const idemKeyIndex = "idem~key"
+const reservedTxIndex = "reservedtx~key"
+
+// TransactionReceipt is the durable, idempotent record of a completed
+// Transaction, keyed by the client-supplied idempotency key so a retried
+// submission can be answered without re-executing the transfer.
+type TransactionReceipt struct {
+	TxID             string
+	IdempotencyKey   string
+	From             string
+	To               string
+	Amount           int
+	SenderBalance    int
+	RecipientBalance int
+	Timestamp        int64
+	ExpiresAt        int64
+}
+
+// TransactionReserved is the intermediate, staged state of a two-phase
+// transaction: the sender has been debited but the recipient has not yet
+// been credited, pending a later SettleTransaction or CancelPending.
+type TransactionReserved struct {
+	IdempotencyKey string
+	From           string
+	To             string
+	Amount         int
+	Settled        bool
+	Cancelled      bool
+	ExpiresAt      int64
+}
+
+// TransactionWithKey performs a transfer of x units from a to b exactly once
+// per idempotencyKey. If a prior, unexpired receipt for idempotencyKey
+// exists, it is returned verbatim instead of re-executing the transfer,
+// making client retries after a network timeout safe. sigHex must be a
+// signature by the participant who owns a over transferPayload(a, b, x,
+// nonce), and nonce must not have been used before by that participant.
+func (t *AccountStorage) TransactionWithKey(ctx contractapi.TransactionContextInterface, a, b string, x int, idempotencyKey string, ttlSeconds int64, nonce int64, sigHex string) (*TransactionReceipt, error) {
+	idemKey, err := ctx.GetStub().CreateCompositeKey(idemKeyIndex, []string{idempotencyKey})
+	if err != nil {
+		return nil, err
+	}
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+	now := txTimestamp.Seconds
+
+	existingBytes, err := ctx.GetStub().GetState(idemKey)
+	if err != nil {
+		return nil, err
+	}
+	if existingBytes != nil {
+		var existing TransactionReceipt
+		if err := json.Unmarshal(existingBytes, &existing); err != nil {
+			return nil, err
+		}
+		if existing.ExpiresAt > now {
+			if existing.From != a || existing.To != b || existing.Amount != x {
+				return nil, fmt.Errorf("idempotency key %s was already used for a different transaction (from=%s to=%s amount=%d)", idempotencyKey, existing.From, existing.To, existing.Amount)
+			}
+			return &existing, nil
+		}
+	}
+
+	if staged, err := t.activeReservationExists(ctx, idempotencyKey, now); err != nil {
+		return nil, err
+	} else if staged {
+		return nil, fmt.Errorf("idempotency key %s is already staged as a pending two-phase transaction", idempotencyKey)
+	}
+
+	if err := t.requireAuthorizedCaller(ctx, a, nonce, transferPayload(a, b, x, nonce), sigHex); err != nil {
+		return nil, err
+	}
+
+	if err := t.transferFunds(ctx, a, b, x); err != nil {
+		return nil, err
+	}
+
+	sender, err := t.ReadAccount(ctx, a)
+	if err != nil {
+		return nil, err
+	}
+	recipient, err := t.ReadAccount(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+
+	receipt := &TransactionReceipt{
+		TxID:             ctx.GetStub().GetTxID(),
+		IdempotencyKey:   idempotencyKey,
+		From:             a,
+		To:               b,
+		Amount:           x,
+		SenderBalance:    sender.Balance,
+		RecipientBalance: recipient.Balance,
+		Timestamp:        now,
+		ExpiresAt:        now + ttlSeconds,
+	}
+
+	receiptBytes, err := json.Marshal(receipt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ctx.GetStub().PutState(idemKey, receiptBytes); err != nil {
+		return nil, err
+	}
+
+	return receipt, nil
+}
+
+// StageTransaction debits a by x and holds the transfer under idempotencyKey
+// without yet crediting b, so it can later be completed with
+// SettleTransaction or rolled back with CancelPending. sigHex must be a
+// signature by the participant who owns a over transferPayload(a, b, x,
+// nonce), and nonce must not have been used before by that participant.
+func (t *AccountStorage) StageTransaction(ctx contractapi.TransactionContextInterface, a, b string, x int, idempotencyKey string, ttlSeconds int64, nonce int64, sigHex string) (*TransactionReserved, error) {
+	reservedKey, err := ctx.GetStub().CreateCompositeKey(reservedTxIndex, []string{idempotencyKey})
+	if err != nil {
+		return nil, err
+	}
+
+	if existing, err := ctx.GetStub().GetState(reservedKey); err != nil {
+		return nil, err
+	} else if existing != nil {
+		return nil, fmt.Errorf("a staged transaction already exists for key %s", idempotencyKey)
+	}
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+
+	if completed, err := t.completedReceiptExists(ctx, idempotencyKey, txTimestamp.Seconds); err != nil {
+		return nil, err
+	} else if completed {
+		return nil, fmt.Errorf("idempotency key %s was already used for a completed transaction", idempotencyKey)
+	}
+
+	if err := t.requireAuthorizedCaller(ctx, a, nonce, transferPayload(a, b, x, nonce), sigHex); err != nil {
+		return nil, err
+	}
+
+	sender, err := t.ReadAccount(ctx, a)
+	if err != nil {
+		return nil, err
+	}
+	recipient, err := t.ReadAccount(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+	if sender.Currency != recipient.Currency {
+		return nil, fmt.Errorf("currency mismatch %s != %s", sender.Currency, recipient.Currency)
+	}
+	if sender.Balance < x {
+		return nil, fmt.Errorf("insufficient balance: have %d, need %d", sender.Balance, x)
+	}
+
+	sender.Balance -= x
+	senderBytes, err := json.Marshal(sender)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(a, senderBytes); err != nil {
+		return nil, err
+	}
+
+	reserved := &TransactionReserved{
+		IdempotencyKey: idempotencyKey,
+		From:           a,
+		To:             b,
+		Amount:         x,
+		ExpiresAt:      txTimestamp.Seconds + ttlSeconds,
+	}
+
+	reservedBytes, err := json.Marshal(reserved)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ctx.GetStub().PutState(reservedKey, reservedBytes); err != nil {
+		return nil, err
+	}
+
+	return reserved, nil
+}
+
+// SettleTransaction completes a previously staged transaction by crediting
+// the recipient, and writes the same TransactionReceipt that
+// TransactionWithKey would have produced had it run in one step. sigHex must
+// be a signature over "SETTLE:"+idempotencyKey by the participant who owns
+// the staged transaction's sender account. The "SETTLE:" prefix keeps this
+// signature from also satisfying CancelPending's check (and vice versa).
+func (t *AccountStorage) SettleTransaction(ctx contractapi.TransactionContextInterface, idempotencyKey string, sigHex string) (*TransactionReceipt, error) {
+	reserved, reservedKey, err := t.readReservedTransaction(ctx, idempotencyKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sender, err := t.ReadAccount(ctx, reserved.From)
+	if err != nil {
+		return nil, err
+	}
+
+	participant, err := t.ReadParticipant(ctx, sender.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	signerPubKey, err := recoverSigner([]byte("SETTLE:"+idempotencyKey), sigHex)
+	if err != nil {
+		return nil, err
+	}
+	if participant.PubKey != signerPubKey {
+		return nil, fmt.Errorf("signature does not match participant %s", sender.Email)
+	}
+
+	recipient, err := t.ReadAccount(ctx, reserved.To)
+	if err != nil {
+		return nil, err
+	}
+	recipient.Balance += reserved.Amount
+	recipientBytes, err := json.Marshal(recipient)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(reserved.To, recipientBytes); err != nil {
+		return nil, err
+	}
+
+	reserved.Settled = true
+	reservedBytes, err := json.Marshal(reserved)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(reservedKey, reservedBytes); err != nil {
+		return nil, err
+	}
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+
+	receipt := &TransactionReceipt{
+		TxID:             ctx.GetStub().GetTxID(),
+		IdempotencyKey:   idempotencyKey,
+		From:             reserved.From,
+		To:               reserved.To,
+		Amount:           reserved.Amount,
+		SenderBalance:    sender.Balance,
+		RecipientBalance: recipient.Balance,
+		Timestamp:        txTimestamp.Seconds,
+		ExpiresAt:        reserved.ExpiresAt,
+	}
+
+	idemKey, err := ctx.GetStub().CreateCompositeKey(idemKeyIndex, []string{idempotencyKey})
+	if err != nil {
+		return nil, err
+	}
+	receiptBytes, err := json.Marshal(receipt)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.GetStub().PutState(idemKey, receiptBytes); err != nil {
+		return nil, err
+	}
+
+	return receipt, nil
+}
+
+// CancelPending rolls back a staged transaction, refunding the sender. sigHex
+// must be a signature over "CANCEL:"+idempotencyKey by the participant who
+// owns the staged transaction's sender account. The "CANCEL:" prefix keeps
+// this signature from also satisfying SettleTransaction's check (and vice
+// versa), since both actions would otherwise sign the same bare
+// idempotencyKey.
+func (t *AccountStorage) CancelPending(ctx contractapi.TransactionContextInterface, idempotencyKey string, sigHex string) error {
+	reserved, reservedKey, err := t.readReservedTransaction(ctx, idempotencyKey)
+	if err != nil {
+		return err
+	}
+
+	sender, err := t.ReadAccount(ctx, reserved.From)
+	if err != nil {
+		return err
+	}
+
+	participant, err := t.ReadParticipant(ctx, sender.Email)
+	if err != nil {
+		return err
+	}
+
+	signerPubKey, err := recoverSigner([]byte("CANCEL:"+idempotencyKey), sigHex)
+	if err != nil {
+		return err
+	}
+	if participant.PubKey != signerPubKey {
+		return fmt.Errorf("signature does not match participant %s", sender.Email)
+	}
+
+	sender.Balance += reserved.Amount
+	senderBytes, err := json.Marshal(sender)
+	if err != nil {
+		return err
+	}
+	if err := ctx.GetStub().PutState(reserved.From, senderBytes); err != nil {
+		return err
+	}
+
+	reserved.Cancelled = true
+	reservedBytes, err := json.Marshal(reserved)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(reservedKey, reservedBytes)
+}
+
+// readReservedTransaction loads the TransactionReserved record for
+// idempotencyKey and validates it is still pending.
+func (t *AccountStorage) readReservedTransaction(ctx contractapi.TransactionContextInterface, idempotencyKey string) (*TransactionReserved, string, error) {
+	reservedKey, err := ctx.GetStub().CreateCompositeKey(reservedTxIndex, []string{idempotencyKey})
+	if err != nil {
+		return nil, "", err
+	}
+
+	reservedBytes, err := ctx.GetStub().GetState(reservedKey)
+	if err != nil {
+		return nil, "", err
+	}
+	if reservedBytes == nil {
+		return nil, "", fmt.Errorf("no staged transaction for key %s", idempotencyKey)
+	}
+
+	var reserved TransactionReserved
+	if err := json.Unmarshal(reservedBytes, &reserved); err != nil {
+		return nil, "", err
+	}
+	if reserved.Settled {
+		return nil, "", fmt.Errorf("staged transaction %s is already settled", idempotencyKey)
+	}
+	if reserved.Cancelled {
+		return nil, "", fmt.Errorf("staged transaction %s is already cancelled", idempotencyKey)
+	}
+
+	return &reserved, reservedKey, nil
+}
+
+// activeReservationExists reports whether idempotencyKey is currently held
+// by an unsettled, uncancelled, unexpired StageTransaction. idemKeyIndex and
+// reservedTxIndex are otherwise never cross-checked, so without this,
+// staging a transfer under a key and then completing it with
+// TransactionWithKey under the same key would silently debit the sender
+// twice instead of being rejected as a reused key.
+func (t *AccountStorage) activeReservationExists(ctx contractapi.TransactionContextInterface, idempotencyKey string, now int64) (bool, error) {
+	reservedKey, err := ctx.GetStub().CreateCompositeKey(reservedTxIndex, []string{idempotencyKey})
+	if err != nil {
+		return false, err
+	}
+
+	reservedBytes, err := ctx.GetStub().GetState(reservedKey)
+	if err != nil {
+		return false, err
+	}
+	if reservedBytes == nil {
+		return false, nil
+	}
+
+	var reserved TransactionReserved
+	if err := json.Unmarshal(reservedBytes, &reserved); err != nil {
+		return false, err
+	}
+
+	return !reserved.Settled && !reserved.Cancelled && reserved.ExpiresAt > now, nil
+}
+
+// completedReceiptExists reports whether idempotencyKey already has an
+// unexpired TransactionReceipt from TransactionWithKey. See
+// activeReservationExists for why StageTransaction must also check this
+// index before debiting.
+func (t *AccountStorage) completedReceiptExists(ctx contractapi.TransactionContextInterface, idempotencyKey string, now int64) (bool, error) {
+	idemKey, err := ctx.GetStub().CreateCompositeKey(idemKeyIndex, []string{idempotencyKey})
+	if err != nil {
+		return false, err
+	}
+
+	receiptBytes, err := ctx.GetStub().GetState(idemKey)
+	if err != nil {
+		return false, err
+	}
+	if receiptBytes == nil {
+		return false, nil
+	}
+
+	var receipt TransactionReceipt
+	if err := json.Unmarshal(receiptBytes, &receipt); err != nil {
+		return false, err
+	}
+
+	return receipt.ExpiresAt > now, nil
+}
+
+// PurgeExpiredIdempotencyKeys deletes up to limit expired
+// TransactionReceipt entries and returns the number purged. Intended to be
+// invoked periodically so the idem~key index does not grow unbounded.
+func (t *AccountStorage) PurgeExpiredIdempotencyKeys(ctx contractapi.TransactionContextInterface, limit int32) (int32, error) {
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+	now := txTimestamp.Seconds
+
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(idemKeyIndex, []string{})
+	if err != nil {
+		return 0, err
+	}
+	defer iterator.Close()
+
+	var purged int32
+	for iterator.HasNext() && purged < limit {
+		responseRange, err := iterator.Next()
+		if err != nil {
+			return purged, err
+		}
+
+		var receipt TransactionReceipt
+		if err := json.Unmarshal(responseRange.Value, &receipt); err != nil {
+			return purged, err
+		}
+
+		if receipt.ExpiresAt <= now {
+			if err := ctx.GetStub().DelState(responseRange.Key); err != nil {
+				return purged, err
+			}
+			purged++
+		}
+	}
+
+	return purged, nil
+}
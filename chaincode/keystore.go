@@ -0,0 +1,248 @@
+package chaincode
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Keyfile mirrors the JSON shape produced by go-ethereum's keystore: a
+// scrypt-derived key encrypts the private key with AES-128-CTR, and a
+// keccak256 MAC over dk[16:32]||ciphertext guards against tampering.
+type Keyfile struct {
+	Version int          `json:"version"`
+	Crypto  CryptoParams `json:"crypto"`
+}
+
+// CryptoParams holds the cipher and KDF parameters of a Keyfile.
+type CryptoParams struct {
+	Cipher       string       `json:"cipher"`
+	CipherText   string       `json:"ciphertext"`
+	CipherParams CipherParams `json:"cipherparams"`
+	KDF          string       `json:"kdf"`
+	KDFParams    KDFParams    `json:"kdfparams"`
+	MAC          string       `json:"mac"`
+}
+
+// CipherParams holds the AES-CTR initialization vector.
+type CipherParams struct {
+	IV string `json:"iv"`
+}
+
+// KDFParams holds the scrypt parameters used to derive the encryption key.
+type KDFParams struct {
+	N     int    `json:"n"`
+	R     int    `json:"r"`
+	P     int    `json:"p"`
+	DKLen int    `json:"dklen"`
+	Salt  string `json:"salt"`
+}
+
+const (
+	scryptN       = 262144
+	scryptR       = 8
+	scryptP       = 1
+	scryptDKLen   = 32
+	keyfileCipher = "aes-128-ctr"
+)
+
+const usedNonceIndex = "noncetx~email~nonce"
+
+// validateKeyfile checks that keyfileJSON is a well-formed Keyfile using the
+// scrypt/AES-128-CTR parameters this ledger requires. It does not and cannot
+// decrypt the keyfile: the passphrase never leaves the client.
+func validateKeyfile(keyfileJSON string) error {
+	var keyfile Keyfile
+	if err := json.Unmarshal([]byte(keyfileJSON), &keyfile); err != nil {
+		return fmt.Errorf("malformed keyfile json: %v", err)
+	}
+
+	if keyfile.Crypto.Cipher != keyfileCipher {
+		return fmt.Errorf("unsupported cipher %s", keyfile.Crypto.Cipher)
+	}
+	if keyfile.Crypto.KDF != "scrypt" {
+		return fmt.Errorf("unsupported kdf %s", keyfile.Crypto.KDF)
+	}
+
+	params := keyfile.Crypto.KDFParams
+	if params.N != scryptN || params.R != scryptR || params.P != scryptP || params.DKLen != scryptDKLen {
+		return fmt.Errorf("unexpected scrypt params N=%d r=%d p=%d dklen=%d", params.N, params.R, params.P, params.DKLen)
+	}
+
+	if keyfile.Crypto.CipherText == "" || keyfile.Crypto.MAC == "" || keyfile.Crypto.CipherParams.IV == "" {
+		return fmt.Errorf("keyfile is missing ciphertext, mac or iv")
+	}
+
+	return nil
+}
+
+// pubKeyFromHex decodes a hex-encoded uncompressed secp256k1 public key.
+func pubKeyFromHex(pubKeyHex string) ([]byte, error) {
+	pubKeyBytes, err := hex.DecodeString(pubKeyHex)
+	if err != nil {
+		return nil, fmt.Errorf("not valid hex: %v", err)
+	}
+
+	if _, err := crypto.UnmarshalPubkey(pubKeyBytes); err != nil {
+		return nil, fmt.Errorf("not a valid secp256k1 public key: %v", err)
+	}
+
+	return pubKeyBytes, nil
+}
+
+// recoverSigner recovers the hex-encoded secp256k1 public key that produced
+// sigHex over keccak256(payload).
+func recoverSigner(payload []byte, sigHex string) (string, error) {
+	sig, err := hex.DecodeString(sigHex)
+	if err != nil {
+		return "", fmt.Errorf("signature is not valid hex: %v", err)
+	}
+
+	digest := crypto.Keccak256(payload)
+	pubKey, err := crypto.SigToPub(digest, sig)
+	if err != nil {
+		return "", fmt.Errorf("failed to recover signer: %v", err)
+	}
+
+	return hex.EncodeToString(crypto.FromECDSAPub(pubKey)), nil
+}
+
+// TransactionPayload is the canonical, signed body of an AuthenticatedTransaction.
+// Nonce must be a value the sending participant has not signed before: it
+// binds the signature to a single use so a captured (payloadJSON, sigHex)
+// pair cannot be resubmitted to replay the transfer.
+type TransactionPayload struct {
+	From   string
+	To     string
+	Amount int
+	Nonce  int64
+}
+
+// AuthenticatedTransaction verifies that sigHex is a valid signature by the
+// participant who owns account payload.From, then performs the transfer
+// described by payloadJSON. payload.Nonce is consumed on success and rejected
+// if seen before, so a captured signed payload cannot be replayed to redebit
+// the sender.
+func (t *AccountStorage) AuthenticatedTransaction(ctx contractapi.TransactionContextInterface, payloadJSON string, sigHex string) error {
+	var payload TransactionPayload
+	if err := json.Unmarshal([]byte(payloadJSON), &payload); err != nil {
+		return fmt.Errorf("malformed payload: %v", err)
+	}
+
+	signerPubKey, err := recoverSigner([]byte(payloadJSON), sigHex)
+	if err != nil {
+		return err
+	}
+
+	sender, err := t.ReadAccount(ctx, payload.From)
+	if err != nil {
+		return err
+	}
+
+	participant, err := t.ReadParticipant(ctx, sender.Email)
+	if err != nil {
+		return err
+	}
+
+	if participant.PubKey != signerPubKey {
+		return fmt.Errorf("signature does not match participant %s", sender.Email)
+	}
+
+	if err := t.consumeNonce(ctx, sender.Email, payload.Nonce); err != nil {
+		return err
+	}
+
+	return t.transferFunds(ctx, payload.From, payload.To, payload.Amount)
+}
+
+// requireAuthorizedCaller verifies that sigHex is a signature over payload by
+// the participant who owns accountID, then consumes nonce so the signature
+// cannot be replayed. Every fund-moving entry point that does not build its
+// own bespoke signed payload (as AuthenticatedTransaction does) routes
+// through this, so that knowing an account ID is never enough on its own to
+// move or lock its funds.
+func (t *AccountStorage) requireAuthorizedCaller(ctx contractapi.TransactionContextInterface, accountID string, nonce int64, payload []byte, sigHex string) error {
+	account, err := t.ReadAccount(ctx, accountID)
+	if err != nil {
+		return err
+	}
+
+	participant, err := t.ReadParticipant(ctx, account.Email)
+	if err != nil {
+		return err
+	}
+
+	signerPubKey, err := recoverSigner(payload, sigHex)
+	if err != nil {
+		return err
+	}
+	if participant.PubKey != signerPubKey {
+		return fmt.Errorf("signature does not match participant %s", account.Email)
+	}
+
+	return t.consumeNonce(ctx, account.Email, nonce)
+}
+
+// consumeNonce rejects nonce if email has already used it, then records it
+// as spent so it cannot be replayed.
+func (t *AccountStorage) consumeNonce(ctx contractapi.TransactionContextInterface, email string, nonce int64) error {
+	nonceKey, err := ctx.GetStub().CreateCompositeKey(usedNonceIndex, []string{email, fmt.Sprintf("%d", nonce)})
+	if err != nil {
+		return err
+	}
+
+	usedBytes, err := ctx.GetStub().GetState(nonceKey)
+	if err != nil {
+		return err
+	}
+	if usedBytes != nil {
+		return fmt.Errorf("nonce %d has already been used by participant %s", nonce, email)
+	}
+
+	return ctx.GetStub().PutState(nonceKey, []byte{0x00})
+}
+
+// ChangePassphrase replaces a participant's encrypted keyfile, e.g. after the
+// client re-encrypts the same private key under a new passphrase. The
+// request must be signed by the participant's existing key so that an
+// attacker who merely knows the email cannot swap in their own keyfile.
+// nonce must not have been used before by email: every submitted transaction
+// (including its args and signature) stays permanently visible on the
+// ledger, so without a nonce an old, valid (email, newEncryptedKeyfile,
+// sigHex) triple could be replayed verbatim to roll the keyfile back to a
+// stale passphrase.
+func (t *AccountStorage) ChangePassphrase(ctx contractapi.TransactionContextInterface, email, newEncryptedKeyfile string, nonce int64, sigHex string) error {
+	participant, err := t.ReadParticipant(ctx, email)
+	if err != nil {
+		return err
+	}
+
+	if err := validateKeyfile(newEncryptedKeyfile); err != nil {
+		return fmt.Errorf("invalid keyfile: %v", err)
+	}
+
+	signerPubKey, err := recoverSigner([]byte(fmt.Sprintf("%s%s%d", email, newEncryptedKeyfile, nonce)), sigHex)
+	if err != nil {
+		return err
+	}
+
+	if participant.PubKey != signerPubKey {
+		return fmt.Errorf("signature does not match participant %s", email)
+	}
+
+	if err := t.consumeNonce(ctx, email, nonce); err != nil {
+		return err
+	}
+
+	participant.Keyfile = newEncryptedKeyfile
+
+	participantBytes, err := json.Marshal(participant)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(email, participantBytes)
+}
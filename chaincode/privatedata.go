@@ -0,0 +1,119 @@
+package chaincode
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// participantPIICollection is the Fabric private data collection that holds
+// participant PII. Its membership policy is defined in
+// collections_config.json.
+const participantPIICollection = "participantPII"
+
+// ParticipantPII holds the personally identifiable fields of a participant.
+// It is stored only in the participantPII private data collection, never in
+// the shared world state.
+type ParticipantPII struct {
+	Name    string
+	Surname string
+	Phone   string
+}
+
+// readParticipantPIITransient reads a participant's PII out of the
+// transaction's transient map rather than its invocation arguments.
+// Invocation arguments are part of the transaction proposal and are
+// propagated in plaintext to every endorsing/committing peer on the
+// channel, regardless of private data collection membership; the transient
+// map is the only part of a Fabric transaction that is not, which is why
+// every private-data sample reads PII this way instead of as a plain param.
+// The client is expected to set the "name", "surname" and "phone" keys.
+func readParticipantPIITransient(ctx contractapi.TransactionContextInterface) (*ParticipantPII, error) {
+	transientMap, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transient data: %v", err)
+	}
+
+	pii := &ParticipantPII{}
+	for _, field := range []struct {
+		key string
+		dst *string
+	}{
+		{"name", &pii.Name},
+		{"surname", &pii.Surname},
+		{"phone", &pii.Phone},
+	} {
+		value, ok := transientMap[field.key]
+		if !ok {
+			return nil, fmt.Errorf("missing %s in transient data", field.key)
+		}
+		*field.dst = string(value)
+	}
+
+	return pii, nil
+}
+
+// hashParticipantPII returns the hex-encoded sha256 hash of a participant's
+// marshalled PII, so members without access to the private collection can
+// still verify a claimed Name/Surname/Phone against the public record.
+func hashParticipantPII(piiBytes []byte) string {
+	sum := sha256.Sum256(piiBytes)
+	return hex.EncodeToString(sum[:])
+}
+
+// ReadParticipantPII returns the private PII of a participant. It only
+// succeeds for callers whose MSP is a member of the participantPII
+// collection policy; Fabric itself enforces that at the peer.
+func (t *AccountStorage) ReadParticipantPII(ctx contractapi.TransactionContextInterface, email string) (*ParticipantPII, error) {
+	piiBytes, err := ctx.GetStub().GetPrivateData(participantPIICollection, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get participant PII for %s: %v", email, err)
+	}
+	if piiBytes == nil {
+		return nil, fmt.Errorf("no PII for participant %s", email)
+	}
+
+	var pii ParticipantPII
+	if err := json.Unmarshal(piiBytes, &pii); err != nil {
+		return nil, err
+	}
+
+	return &pii, nil
+}
+
+// VerifyParticipantHash reports whether expectedHash matches the public
+// PIIHash recorded for email, letting members who cannot read the private
+// collection confirm a PII value was not tampered with.
+func (t *AccountStorage) VerifyParticipantHash(ctx contractapi.TransactionContextInterface, email, expectedHash string) (bool, error) {
+	participant, err := t.ReadParticipant(ctx, email)
+	if err != nil {
+		return false, err
+	}
+
+	return participant.PIIHash == expectedHash, nil
+}
+
+// RedactParticipant implements right-to-be-forgotten: it deletes a
+// participant's entry from the participantPII private data collection while
+// leaving the public composite-key skeleton (the Participant record and its
+// doc~type index) intact. sigHex must be a signature over email by the
+// participant's own key, so only the participant can erase their own PII.
+func (t *AccountStorage) RedactParticipant(ctx contractapi.TransactionContextInterface, email, sigHex string) error {
+	participant, err := t.ReadParticipant(ctx, email)
+	if err != nil {
+		return err
+	}
+
+	signerPubKey, err := recoverSigner([]byte(email), sigHex)
+	if err != nil {
+		return err
+	}
+	if participant.PubKey != signerPubKey {
+		return fmt.Errorf("signature does not match participant %s", email)
+	}
+
+	return ctx.GetStub().DelPrivateData(participantPIICollection, email)
+}
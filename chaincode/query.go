@@ -0,0 +1,177 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// PagedAccountsResult is a single page of a CouchDB-backed account query.
+type PagedAccountsResult struct {
+	Records      []*Account
+	FetchedCount int32
+	Bookmark     string
+}
+
+// PagedParticipantsResult is a single page of a CouchDB-backed participant query.
+type PagedParticipantsResult struct {
+	Records      []*Participant
+	FetchedCount int32
+	Bookmark     string
+}
+
+// QueryAccounts runs a rich CouchDB selector query against accounts and
+// returns a single page of results. bookmark should be empty on the first
+// call and is then passed back in on subsequent calls to page through the
+// result set. Requires CouchDB as the state database.
+func (t *AccountStorage) QueryAccounts(ctx contractapi.TransactionContextInterface, selectorJSON string, pageSize int32, bookmark string) (*PagedAccountsResult, error) {
+	resultsIterator, metadata, err := ctx.GetStub().GetQueryResultWithPagination(selectorJSON, pageSize, bookmark)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query accounts: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var accounts []*Account
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var account Account
+		if err := json.Unmarshal(response.Value, &account); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, &account)
+	}
+
+	return &PagedAccountsResult{
+		Records:      accounts,
+		FetchedCount: metadata.FetchedRecordsCount,
+		Bookmark:     metadata.Bookmark,
+	}, nil
+}
+
+// QueryParticipants runs a rich CouchDB selector query against participants
+// and returns a single page of results, paging the same way as QueryAccounts.
+func (t *AccountStorage) QueryParticipants(ctx contractapi.TransactionContextInterface, selectorJSON string, pageSize int32, bookmark string) (*PagedParticipantsResult, error) {
+	resultsIterator, metadata, err := ctx.GetStub().GetQueryResultWithPagination(selectorJSON, pageSize, bookmark)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query participants: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var participants []*Participant
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var participant Participant
+		if err := json.Unmarshal(response.Value, &participant); err != nil {
+			return nil, err
+		}
+		participants = append(participants, &participant)
+	}
+
+	return &PagedParticipantsResult{
+		Records:      participants,
+		FetchedCount: metadata.FetchedRecordsCount,
+		Bookmark:     metadata.Bookmark,
+	}, nil
+}
+
+// QueryAccountsByCurrency returns a page of accounts whose Currency matches currency.
+func (t *AccountStorage) QueryAccountsByCurrency(ctx contractapi.TransactionContextInterface, currency string, pageSize int32, bookmark string) (*PagedAccountsResult, error) {
+	selector, err := json.Marshal(map[string]interface{}{
+		"selector": map[string]interface{}{
+			"Currency": currency,
+			"Balance":  map[string]interface{}{"$exists": true},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t.QueryAccounts(ctx, string(selector), pageSize, bookmark)
+}
+
+// QueryAccountsByBalanceRange returns a page of accounts in currency whose
+// Balance falls within [min, max].
+func (t *AccountStorage) QueryAccountsByBalanceRange(ctx contractapi.TransactionContextInterface, min, max int, currency string, pageSize int32, bookmark string) (*PagedAccountsResult, error) {
+	selector, err := json.Marshal(map[string]interface{}{
+		"selector": map[string]interface{}{
+			"Currency": currency,
+			"Balance": map[string]interface{}{
+				"$gte": min,
+				"$lte": max,
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t.QueryAccounts(ctx, string(selector), pageSize, bookmark)
+}
+
+// PagedHistoryResult is a single page of account history.
+type PagedHistoryResult struct {
+	Records      []HistoryQueryResult
+	FetchedCount int32
+	Bookmark     string
+}
+
+// GetAccountHistoryPaginated returns a page of an account's history, using
+// the same bookmark convention as QueryAccounts. This is NOT a cost-saving
+// pagination: the chaincode shim's GetHistoryForKey iterator has no native
+// resume support, so every call still re-reads the key's entire history via
+// GetAccountHistory before slicing the requested page out of memory. Use
+// this only to keep a single response small; it does not avoid scanning the
+// full ledger history for the key.
+func (t *AccountStorage) GetAccountHistoryPaginated(ctx contractapi.TransactionContextInterface, id string, pageSize int32, bookmark string) (*PagedHistoryResult, error) {
+	history, err := t.GetAccountHistory(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	start := 0
+	if bookmark != "" {
+		offset, err := parseHistoryBookmark(bookmark)
+		if err != nil {
+			return nil, err
+		}
+		start = offset
+	}
+
+	if start > len(history) {
+		start = len(history)
+	}
+
+	end := start + int(pageSize)
+	if pageSize <= 0 || end > len(history) {
+		end = len(history)
+	}
+
+	page := history[start:end]
+
+	nextBookmark := ""
+	if end < len(history) {
+		nextBookmark = fmt.Sprintf("%d", end)
+	}
+
+	return &PagedHistoryResult{
+		Records:      page,
+		FetchedCount: int32(len(page)),
+		Bookmark:     nextBookmark,
+	}, nil
+}
+
+// parseHistoryBookmark decodes the offset encoded in a GetAccountHistoryPaginated bookmark.
+func parseHistoryBookmark(bookmark string) (int, error) {
+	var offset int
+	if _, err := fmt.Sscanf(bookmark, "%d", &offset); err != nil {
+		return 0, fmt.Errorf("invalid bookmark %q: %v", bookmark, err)
+	}
+	return offset, nil
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"time"
 	"encoding/json"
-	"github.com/shomali11/util/xhashes"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
 )
@@ -17,13 +16,16 @@ type AccountStorage struct {
 	contractapi.Contract
 }
 
+// Participant is the public projection of a participant: everything here is
+// visible to every member of the channel. Personally identifiable fields
+// (name, surname, phone) live only in the participantPII private data
+// collection — see privatedata.go.
 type Participant struct {
 	DocType string
 	Email   string
-	Name    string
-	Surname string
-	Phone   string
-	Passwd  string
+	PubKey  string
+	Keyfile string
+	PIIHash string
 }
 
 type Account struct {
@@ -38,6 +40,7 @@ type HistoryQueryResult struct {
 	TxId      string
 	Timestamp time.Time
 	IsDelete  bool
+	FXTrade   *FXTrade
 }
 
 // ParticipantExists returns true when participant with given Email exists in the ledger
@@ -50,8 +53,18 @@ func (t *AccountStorage) ParticipantExists(ctx contractapi.TransactionContextInt
 	return participantBytes != nil, nil
 }
 
-// CreatePatricipant initializes a new participant in the ledger
-func (t *AccountStorage) CreateParticipant(ctx contractapi.TransactionContextInterface, email, name, surname, phone, passwd string) error {
+// CreateParticipant initializes a new participant in the ledger. The caller's
+// secret material never reaches the chaincode: pubKeyHex is the hex-encoded
+// secp256k1 public key the participant will sign with, and keyfileJSON is the
+// scrypt-encrypted keystore blob (see keystore.go) that only the client can
+// decrypt. name, surname and phone are PII and must NOT be passed as plain
+// invocation arguments — those are part of the transaction proposal and are
+// propagated in plaintext to every endorsing/committing peer on the channel,
+// private collection or not. The client instead sends them in the transient
+// map (see readParticipantPIITransient in privatedata.go); only a hash of
+// them is kept publicly, and the PII itself is written to the
+// participantPII private data collection (see privatedata.go).
+func (t *AccountStorage) CreateParticipant(ctx contractapi.TransactionContextInterface, email, pubKeyHex, keyfileJSON string) error {
 	exists, err := t.ParticipantExists(ctx, email)
 	if err != nil {
 		return fmt.Errorf("failed to get participant: %v", err)
@@ -60,13 +73,33 @@ func (t *AccountStorage) CreateParticipant(ctx contractapi.TransactionContextInt
 		return fmt.Errorf("participan already exists: %s", email)
 	}
 
+	if err := validateKeyfile(keyfileJSON); err != nil {
+		return fmt.Errorf("invalid keyfile: %v", err)
+	}
+
+	if _, err := pubKeyFromHex(pubKeyHex); err != nil {
+		return fmt.Errorf("invalid public key: %v", err)
+	}
+
+	pii, err := readParticipantPIITransient(ctx)
+	if err != nil {
+		return err
+	}
+	piiBytes, err := json.Marshal(pii)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.GetStub().PutPrivateData(participantPIICollection, email, piiBytes); err != nil {
+		return fmt.Errorf("failed to put participant PII: %v", err)
+	}
+
 	participant := &Participant{
 		DocType: "participant",
 		Email:   email,
-		Name:    name,
-		Surname: surname,
-		Phone:   phone,
-		Passwd:  xhashes.MD5(passwd),
+		PubKey:  pubKeyHex,
+		Keyfile: keyfileJSON,
+		PIIHash: hashParticipantPII(piiBytes),
 	}
 	participantBytes, err := json.Marshal(participant)
 	if err != nil {
@@ -171,8 +204,31 @@ func (t *AccountStorage) ReadAccount(ctx contractapi.TransactionContextInterface
 	return &account, nil
 }
 
-// Transaction makes payment of x units from a to b
-func (t *AccountStorage) Transaction(ctx contractapi.TransactionContextInterface, a, b string, x int) error {
+// Transaction makes payment of x units from a to b. sigHex must be a
+// signature by the participant who owns a over a deterministic encoding of
+// (a, b, x, nonce), and nonce must not have been used before by that
+// participant — see requireAuthorizedCaller in keystore.go. Without this,
+// knowing two account IDs would be enough to move funds between them with
+// no proof the caller controls the sending account.
+func (t *AccountStorage) Transaction(ctx contractapi.TransactionContextInterface, a, b string, x int, nonce int64, sigHex string) error {
+	if err := t.requireAuthorizedCaller(ctx, a, nonce, transferPayload(a, b, x, nonce), sigHex); err != nil {
+		return err
+	}
+
+	return t.transferFunds(ctx, a, b, x)
+}
+
+// transferPayload is the deterministic byte encoding signed by the sender
+// when authorizing a transfer of x units from a to b under nonce.
+func transferPayload(a, b string, x int, nonce int64) []byte {
+	return []byte(fmt.Sprintf("%s%s%d%d", a, b, x, nonce))
+}
+
+// transferFunds moves x units from a to b. It performs no authorization
+// check of its own: every exported entry point that ends up here (
+// Transaction, AuthenticatedTransaction, TransactionWithKey) must have
+// already established that the caller is entitled to debit a.
+func (t *AccountStorage) transferFunds(ctx contractapi.TransactionContextInterface, a, b string, x int) error {
 	var sender, recipient *Account
 	var err error
 
@@ -215,7 +271,8 @@ func (t *AccountStorage) Transaction(ctx contractapi.TransactionContextInterface
 	return ctx.GetStub().PutState(b, recipientBytes)
 }
 
-// GetAllParticipants returns all participants
+// GetAllParticipants returns the public projection of every participant; PII
+// lives in the participantPII private data collection and is never included.
 func (t *AccountStorage) GetAllParticipants(ctx contractapi.TransactionContextInterface) ([]*Participant, error) {
 	participantResultsIterator, err := ctx.GetStub().GetStateByPartialCompositeKey(docTypeIndex, []string{"participant"})
 	if err != nil {
@@ -281,7 +338,34 @@ func (t *AccountStorage) GetParticipantAccounts(ctx contractapi.TransactionConte
 	return accounts, nil
 }
 
-// GetAccountHistory returns the chain of custody for an account since issuance.
+// lookupFXTrade returns the FXTrade audit record for txID, or nil if that
+// transaction did not go through CrossCurrencyTransaction.
+func (t *AccountStorage) lookupFXTrade(ctx contractapi.TransactionContextInterface, txID string) (*FXTrade, error) {
+	tradeKey, err := ctx.GetStub().CreateCompositeKey(fxTradeIndex, []string{txID})
+	if err != nil {
+		return nil, err
+	}
+
+	tradeBytes, err := ctx.GetStub().GetState(tradeKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get fx trade %s: %v", txID, err)
+	}
+	if tradeBytes == nil {
+		return nil, nil
+	}
+
+	var trade FXTrade
+	if err := json.Unmarshal(tradeBytes, &trade); err != nil {
+		return nil, err
+	}
+
+	return &trade, nil
+}
+
+// GetAccountHistory returns the chain of custody for an account since
+// issuance. Entries produced by CrossCurrencyTransaction carry their FXTrade
+// conversion leg in the FXTrade field (see fx.go); all other entries leave
+// it nil.
 func (t *AccountStorage) GetAccountHistory(ctx contractapi.TransactionContextInterface, id string) ([]HistoryQueryResult, error) {
 	log.Printf("GetAccountHistory: ID %v", id)
 
@@ -315,11 +399,17 @@ func (t *AccountStorage) GetAccountHistory(ctx contractapi.TransactionContextInt
 			return nil, err
 		}
 
+		fxTrade, err := t.lookupFXTrade(ctx, response.TxId)
+		if err != nil {
+			return nil, err
+		}
+
 		record := HistoryQueryResult{
 			TxId:      response.TxId,
 			Timestamp: timestamp,
 			Record:    &account,
 			IsDelete:  response.IsDelete,
+			FXTrade:   fxTrade,
 		}
 		records = append(records, record)
 	}
@@ -0,0 +1,470 @@
+package chaincode
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const utxoAccountIndex = "utxo~account~id"
+const reservationIndex = "reservation~id"
+
+// UTXO represents a single unspent transaction output owned by an account.
+type UTXO struct {
+	ID        string
+	AccountID string
+	Currency  string
+	Amount    int
+	Spent     bool
+	TxRef     string
+}
+
+// Output describes a single output of a SpendUTXOs call: how much of which
+// currency should end up on which account.
+type Output struct {
+	AccountID string
+	Currency  string
+	Amount    int
+}
+
+// Reservation soft-locks a set of UTXOs so that a later transaction can spend
+// them without racing concurrent transactions in the same block.
+type Reservation struct {
+	ID        string
+	AccountID string
+	UTXOIDs   []string
+	Amount    int
+	Currency  string
+	ExpiresAt int64
+}
+
+// reservedIDs returns the UTXO IDs locked by r, or nil for a nil reservation.
+func (r *Reservation) reservedIDs() []string {
+	if r == nil {
+		return nil
+	}
+	return r.UTXOIDs
+}
+
+// utxoExists returns true when a UTXO with the given ID exists in the ledger.
+func (t *AccountStorage) utxoExists(ctx contractapi.TransactionContextInterface, id string) (bool, error) {
+	utxoBytes, err := ctx.GetStub().GetState(id)
+	if err != nil {
+		return false, fmt.Errorf("failed to read utxo %s from world state. %v", id, err)
+	}
+
+	return utxoBytes != nil, nil
+}
+
+// putUTXO writes a UTXO to world state and indexes it under utxo~account~id.
+func (t *AccountStorage) putUTXO(ctx contractapi.TransactionContextInterface, utxo *UTXO) error {
+	utxoBytes, err := json.Marshal(utxo)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.GetStub().PutState(utxo.ID, utxoBytes); err != nil {
+		return err
+	}
+
+	utxoAccountIndexKey, err := ctx.GetStub().CreateCompositeKey(utxoAccountIndex, []string{utxo.AccountID, utxo.ID})
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(utxoAccountIndexKey, []byte{0x00})
+}
+
+// ReadUTXO retrieves a UTXO from the ledger.
+func (t *AccountStorage) ReadUTXO(ctx contractapi.TransactionContextInterface, id string) (*UTXO, error) {
+	utxoBytes, err := ctx.GetStub().GetState(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get utxo %s: %v", id, err)
+	}
+	if utxoBytes == nil {
+		return nil, fmt.Errorf("utxo %s does not exist", id)
+	}
+
+	var utxo UTXO
+	if err := json.Unmarshal(utxoBytes, &utxo); err != nil {
+		return nil, err
+	}
+
+	return &utxo, nil
+}
+
+// MintUTXO creates a brand new unspent output for an account, e.g. to seed an
+// account or to record an external deposit. id must not already be in use.
+// Minting creates money rather than moving money a participant already
+// holds, so it is gated the same way SetFXRate is — by the admin role
+// (requireAdmin in fx.go) — rather than by the recipient's own signature:
+// requiring accountID's owner to co-sign their own incoming deposit would
+// not actually be more secure (the owner isn't the one attesting to the
+// external event being recorded), and an admin-only gate still closes the
+// original gap of anyone being able to call this with just an account ID.
+func (t *AccountStorage) MintUTXO(ctx contractapi.TransactionContextInterface, id, accountID, currency string, amount int, txRef string) error {
+	if err := t.requireAdmin(ctx); err != nil {
+		return err
+	}
+
+	exists, err := t.utxoExists(ctx, id)
+	if err != nil {
+		return fmt.Errorf("failed to get utxo: %v", err)
+	}
+	if exists {
+		return fmt.Errorf("utxo already exists: %s", id)
+	}
+
+	if amount <= 0 {
+		return fmt.Errorf("amount must be positive, got %d", amount)
+	}
+
+	utxo := &UTXO{
+		ID:        id,
+		AccountID: accountID,
+		Currency:  currency,
+		Amount:    amount,
+		Spent:     false,
+		TxRef:     txRef,
+	}
+
+	return t.putUTXO(ctx, utxo)
+}
+
+// ListUTXOs returns every unspent output owned by accountID.
+func (t *AccountStorage) ListUTXOs(ctx contractapi.TransactionContextInterface, accountID string) ([]*UTXO, error) {
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(utxoAccountIndex, []string{accountID})
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	var utxos []*UTXO
+	for iterator.HasNext() {
+		responseRange, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		_, compositeKeyParts, err := ctx.GetStub().SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(compositeKeyParts) > 1 {
+			utxo, err := t.ReadUTXO(ctx, compositeKeyParts[1])
+			if err != nil {
+				return nil, err
+			}
+			if !utxo.Spent {
+				utxos = append(utxos, utxo)
+			}
+		}
+	}
+
+	return utxos, nil
+}
+
+// spendUTXOsPayload is the deterministic byte encoding signed by accountID's
+// owner when authorizing a SpendUTXOs call.
+func spendUTXOsPayload(accountID, reservationID string, inputs []string, outputs []Output, nonce int64) ([]byte, error) {
+	return json.Marshal(struct {
+		AccountID     string
+		ReservationID string
+		Inputs        []string
+		Outputs       []Output
+		Nonce         int64
+	}{accountID, reservationID, inputs, outputs, nonce})
+}
+
+// SpendUTXOs atomically consumes inputs owned by accountID and creates one new
+// UTXO per requested output, returning any change back to accountID. All
+// inputs must belong to accountID, be unspent, share a single currency and
+// sum to at least the total of outputs. sigHex must be a signature by the
+// participant who owns accountID over spendUTXOsPayload(...), and nonce must
+// not have been used before by that participant.
+//
+// If any input is currently soft-locked by an unexpired ReserveUTXOs call,
+// the spend is rejected unless reservationID identifies that very
+// reservation, proving the caller actually holds the lock; reservationID may
+// be empty when none of the inputs is expected to be reserved. A reservation
+// passed here is consumed (deleted) on success, so it cannot be replayed to
+// spend the same inputs a second time.
+func (t *AccountStorage) SpendUTXOs(ctx contractapi.TransactionContextInterface, accountID, reservationID string, inputs []string, outputs []Output, nonce int64, sigHex string) error {
+	if len(inputs) == 0 {
+		return fmt.Errorf("at least one input utxo is required")
+	}
+	if len(outputs) == 0 {
+		return fmt.Errorf("at least one output is required")
+	}
+
+	payload, err := spendUTXOsPayload(accountID, reservationID, inputs, outputs, nonce)
+	if err != nil {
+		return err
+	}
+	if err := t.requireAuthorizedCaller(ctx, accountID, nonce, payload, sigHex); err != nil {
+		return err
+	}
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+
+	var reservation *Reservation
+	if reservationID != "" {
+		reservation, err = t.readReservation(ctx, reservationID)
+		if err != nil {
+			return err
+		}
+		if reservation.AccountID != accountID {
+			return fmt.Errorf("reservation %s does not belong to account %s", reservationID, accountID)
+		}
+		if reservation.ExpiresAt <= txTimestamp.Seconds {
+			return fmt.Errorf("reservation %s has expired", reservationID)
+		}
+	}
+
+	heldByReservation := make(map[string]bool)
+	for _, id := range reservation.reservedIDs() {
+		heldByReservation[id] = true
+	}
+
+	reserved, err := t.reservedUTXOIDs(ctx, accountID, txTimestamp.Seconds)
+	if err != nil {
+		return err
+	}
+
+	inputUTXOs := make([]*UTXO, 0, len(inputs))
+	var currency string
+	var total int
+	seenInputs := make(map[string]bool, len(inputs))
+
+	for _, id := range inputs {
+		if seenInputs[id] {
+			return fmt.Errorf("utxo %s is listed more than once among inputs", id)
+		}
+		seenInputs[id] = true
+
+		utxo, err := t.ReadUTXO(ctx, id)
+		if err != nil {
+			return err
+		}
+		if utxo.AccountID != accountID {
+			return fmt.Errorf("utxo %s does not belong to account %s", id, accountID)
+		}
+		if utxo.Spent {
+			return fmt.Errorf("utxo %s is already spent", id)
+		}
+		if reserved[id] && !heldByReservation[id] {
+			return fmt.Errorf("utxo %s is reserved by another transaction", id)
+		}
+		if currency == "" {
+			currency = utxo.Currency
+		} else if utxo.Currency != currency {
+			return fmt.Errorf("currency mismatch among inputs %s != %s", utxo.Currency, currency)
+		}
+
+		inputUTXOs = append(inputUTXOs, utxo)
+		total += utxo.Amount
+	}
+
+	var outputTotal int
+	for _, output := range outputs {
+		if output.Currency != currency {
+			return fmt.Errorf("currency mismatch %s != %s", output.Currency, currency)
+		}
+		outputTotal += output.Amount
+	}
+
+	if total < outputTotal {
+		return fmt.Errorf("insufficient input amount: have %d, need %d", total, outputTotal)
+	}
+
+	txID := ctx.GetStub().GetTxID()
+
+	for _, utxo := range inputUTXOs {
+		utxo.Spent = true
+		if err := t.putUTXO(ctx, utxo); err != nil {
+			return err
+		}
+	}
+
+	for i, output := range outputs {
+		newUTXO := &UTXO{
+			ID:        fmt.Sprintf("%s-out-%d", txID, i),
+			AccountID: output.AccountID,
+			Currency:  output.Currency,
+			Amount:    output.Amount,
+			Spent:     false,
+			TxRef:     txID,
+		}
+		if err := t.putUTXO(ctx, newUTXO); err != nil {
+			return err
+		}
+	}
+
+	if change := total - outputTotal; change > 0 {
+		changeUTXO := &UTXO{
+			ID:        fmt.Sprintf("%s-change", txID),
+			AccountID: accountID,
+			Currency:  currency,
+			Amount:    change,
+			Spent:     false,
+			TxRef:     txID,
+		}
+		if err := t.putUTXO(ctx, changeUTXO); err != nil {
+			return err
+		}
+	}
+
+	if reservation != nil {
+		if err := t.deleteReservation(ctx, reservationID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reservePayload is the deterministic byte encoding signed by accountID's
+// owner when authorizing a ReserveUTXOs call.
+func reservePayload(reservationID, accountID, currency string, amount int, ttlSeconds, nonce int64) []byte {
+	return []byte(fmt.Sprintf("%s%s%s%d%d%d", reservationID, accountID, currency, amount, ttlSeconds, nonce))
+}
+
+// ReserveUTXOs soft-locks enough unspent outputs of accountID to cover amount
+// in currency, so that concurrent transactions in the same block cannot
+// double-spend them. The reservation expires ttlSeconds after the current
+// transaction timestamp. sigHex must be a signature by the participant who
+// owns accountID over reservePayload(...), and nonce must not have been used
+// before by that participant.
+func (t *AccountStorage) ReserveUTXOs(ctx contractapi.TransactionContextInterface, reservationID, accountID string, amount int, currency string, ttlSeconds int64, nonce int64, sigHex string) error {
+	if err := t.requireAuthorizedCaller(ctx, accountID, nonce, reservePayload(reservationID, accountID, currency, amount, ttlSeconds, nonce), sigHex); err != nil {
+		return err
+	}
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+
+	utxos, err := t.ListUTXOs(ctx, accountID)
+	if err != nil {
+		return err
+	}
+
+	reserved, err := t.reservedUTXOIDs(ctx, accountID, txTimestamp.Seconds)
+	if err != nil {
+		return err
+	}
+
+	var picked []string
+	var total int
+	for _, utxo := range utxos {
+		if utxo.Currency != currency {
+			continue
+		}
+		if reserved[utxo.ID] {
+			continue
+		}
+		picked = append(picked, utxo.ID)
+		total += utxo.Amount
+		if total >= amount {
+			break
+		}
+	}
+
+	if total < amount {
+		return fmt.Errorf("insufficient unreserved utxos for account %s: have %d, need %d", accountID, total, amount)
+	}
+
+	reservation := &Reservation{
+		ID:        reservationID,
+		AccountID: accountID,
+		UTXOIDs:   picked,
+		Amount:    amount,
+		Currency:  currency,
+		ExpiresAt: txTimestamp.Seconds + ttlSeconds,
+	}
+
+	reservationBytes, err := json.Marshal(reservation)
+	if err != nil {
+		return err
+	}
+
+	reservationKey, err := ctx.GetStub().CreateCompositeKey(reservationIndex, []string{reservationID})
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(reservationKey, reservationBytes)
+}
+
+// readReservation retrieves a reservation from the ledger by its ID.
+func (t *AccountStorage) readReservation(ctx contractapi.TransactionContextInterface, reservationID string) (*Reservation, error) {
+	reservationKey, err := ctx.GetStub().CreateCompositeKey(reservationIndex, []string{reservationID})
+	if err != nil {
+		return nil, err
+	}
+
+	reservationBytes, err := ctx.GetStub().GetState(reservationKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get reservation %s: %v", reservationID, err)
+	}
+	if reservationBytes == nil {
+		return nil, fmt.Errorf("reservation %s does not exist", reservationID)
+	}
+
+	var reservation Reservation
+	if err := json.Unmarshal(reservationBytes, &reservation); err != nil {
+		return nil, err
+	}
+
+	return &reservation, nil
+}
+
+// deleteReservation removes a reservation from the ledger, releasing the
+// UTXOs it held so they can be spent or reserved again.
+func (t *AccountStorage) deleteReservation(ctx contractapi.TransactionContextInterface, reservationID string) error {
+	reservationKey, err := ctx.GetStub().CreateCompositeKey(reservationIndex, []string{reservationID})
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().DelState(reservationKey)
+}
+
+// reservedUTXOIDs returns the set of UTXO IDs currently locked by unexpired
+// reservations belonging to accountID.
+func (t *AccountStorage) reservedUTXOIDs(ctx contractapi.TransactionContextInterface, accountID string, nowSeconds int64) (map[string]bool, error) {
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(reservationIndex, []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	reserved := make(map[string]bool)
+	for iterator.HasNext() {
+		responseRange, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var reservation Reservation
+		if err := json.Unmarshal(responseRange.Value, &reservation); err != nil {
+			return nil, err
+		}
+
+		if reservation.AccountID != accountID || reservation.ExpiresAt <= nowSeconds {
+			continue
+		}
+
+		for _, id := range reservation.UTXOIDs {
+			reserved[id] = true
+		}
+	}
+
+	return reserved, nil
+}